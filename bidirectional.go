@@ -0,0 +1,179 @@
+package duetbackup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ConflictPolicy controls how Reconcile resolves a file that exists on both
+// the local and the remote side but differs between them.
+type ConflictPolicy string
+
+const (
+	// ConflictNewerWins keeps whichever side has the more recent mtime.
+	ConflictNewerWins ConflictPolicy = "newer-wins"
+	// ConflictRemoteWins always keeps the remote (Duet) version.
+	ConflictRemoteWins ConflictPolicy = "remote-wins"
+	// ConflictLocalWins always keeps the local version.
+	ConflictLocalWins ConflictPolicy = "local-wins"
+	// ConflictRenameConflict keeps both versions: the losing local copy is
+	// renamed to "<name>.conflict-<timestamp>" instead of being overwritten.
+	ConflictRenameConflict ConflictPolicy = "rename-conflict"
+)
+
+// Reconcile synchronizes folder on the Duet with outDir in both directions:
+// files that exist on only one side are copied to the other, and files that
+// exist on both sides but disagree are resolved using policy. Change
+// detection uses db.Checksum's hash comparison when enabled, falling back
+// to size+mtime otherwise.
+func (db *DuetBackup) Reconcile(ctx context.Context, folder, outDir string, excls Excludes, policy ConflictPolicy) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if excls.Contains(folder) {
+		log.Println("Excluding", folder)
+		return nil
+	}
+
+	if err := db.ensureOutDirExists(outDir); err != nil {
+		return err
+	}
+
+	fl, err := db.rfm.GetFilelist(ctx, folder)
+	if err != nil {
+		return err
+	}
+	remote := remoteInfoMap(fl)
+
+	localEntries, err := ioutil.ReadDir(outDir)
+	if err != nil {
+		return err
+	}
+	local := make(map[string]os.FileInfo, len(localEntries))
+	for _, e := range localEntries {
+		if e.Name() == dirMarker {
+			continue
+		}
+		local[e.Name()] = e
+	}
+
+	names := make(map[string]struct{}, len(remote)+len(local))
+	for name := range remote {
+		names[name] = struct{}{}
+	}
+	for name := range local {
+		names[name] = struct{}{}
+	}
+
+	for name := range names {
+		remoteFilename := fmt.Sprintf("%s/%s", fl.Dir, name)
+		if excls.Contains(remoteFilename) {
+			if db.verbose {
+				log.Println("  Excluding: ", remoteFilename)
+			}
+			continue
+		}
+		localPath := filepath.Join(outDir, name)
+
+		ri, remoteExists := remote[name]
+		li, localExists := local[name]
+
+		switch {
+		case remoteExists && ri.isDir:
+			if !localExists {
+				if err := os.Mkdir(localPath, 0755); err != nil {
+					return err
+				}
+			}
+			if err := db.Reconcile(ctx, remoteFilename, localPath, excls, policy); err != nil {
+				return err
+			}
+		case remoteExists && !localExists:
+			if _, err := db.downloadAndWrite(ctx, remoteFilename, localPath, ri.date, ""); err != nil {
+				return err
+			}
+			if db.verbose {
+				log.Println("  Added locally: ", remoteFilename)
+			}
+		case !remoteExists && li.IsDir():
+			if err := db.rfm.Mkdir(ctx, remoteFilename); err != nil {
+				return err
+			}
+			if err := db.Reconcile(ctx, remoteFilename, localPath, excls, policy); err != nil {
+				return err
+			}
+		case !remoteExists && localExists:
+			if err := db.uploadFile(ctx, localPath, remoteFilename, li); err != nil {
+				return err
+			}
+			if db.verbose {
+				log.Println("  Added remotely:", remoteFilename)
+			}
+		default:
+			if err := db.reconcileFile(ctx, remoteFilename, localPath, ri, li, policy); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// reconcileFile resolves a file that exists on both sides once it is known
+// to differ, according to policy.
+func (db *DuetBackup) reconcileFile(ctx context.Context, remoteFilename, localPath string, ri remoteInfo, li os.FileInfo, policy ConflictPolicy) error {
+	changed, remoteHash, err := db.needsUpdate(ctx, remoteFilename, localPath, ri.size, ri.date, li)
+	if err != nil {
+		return err
+	}
+
+	// RRF timestamps have whole-second precision, so compare at that
+	// resolution to keep an earlier upload from looking newer locally.
+	localNewer := li.ModTime().Truncate(time.Second).After(ri.date)
+
+	// Without a hash, needsUpdate only notices a newer remote copy; a newer
+	// local copy or a differing size means the two sides differ as well.
+	if !changed && remoteHash == "" {
+		changed = localNewer || uint64(li.Size()) != ri.size
+	}
+	if !changed {
+		if db.verbose {
+			log.Println("  Up-to-date:", remoteFilename)
+		}
+		return nil
+	}
+
+	switch policy {
+	case ConflictLocalWins:
+		return db.uploadFile(ctx, localPath, remoteFilename, li)
+	case ConflictRemoteWins:
+		_, err := db.downloadAndWrite(ctx, remoteFilename, localPath, ri.date, remoteHash)
+		return err
+	case ConflictRenameConflict:
+		// Always preserve the local copy before overwriting it, regardless
+		// of which side happens to be newer: the whole point of this policy
+		// is to keep both versions rather than have the mtime race decide
+		// which one is silently discarded.
+		conflictPath := fmt.Sprintf("%s.conflict-%s", localPath, time.Now().Format("20060102-150405"))
+		if err := os.Rename(localPath, conflictPath); err != nil {
+			return err
+		}
+		if db.verbose {
+			log.Println("  Conflict, kept local copy as", conflictPath)
+		}
+		_, err := db.downloadAndWrite(ctx, remoteFilename, localPath, ri.date, remoteHash)
+		return err
+	default: // ConflictNewerWins
+		if localNewer {
+			return db.uploadFile(ctx, localPath, remoteFilename, li)
+		}
+		_, err := db.downloadAndWrite(ctx, remoteFilename, localPath, ri.date, remoteHash)
+		return err
+	}
+}
@@ -1,19 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/wilriker/duetbackup"
-	"github.com/wilriker/librfm"
+	"github.com/wilriker/rrffm"
 )
 
 func main() {
-	var domain, dirToBackup, outDir, password string
-	var removeLocal, verbose bool
+	var domain, dirToBackup, outDir, password, conflictPolicy string
+	var removeLocal, verbose, checksum, restore, bidirectional bool
 	var port uint64
+	var parallel int
 	var excls duetbackup.Excludes
 
 	flag.StringVar(&domain, "domain", "", "Domain of Duet Wifi")
@@ -23,6 +27,11 @@ func main() {
 	flag.StringVar(&dirToBackup, "dirToBackup", duetbackup.SysDir, "Directory on Duet to create a backup of")
 	flag.StringVar(&outDir, "outDir", "", "Output dir of backup")
 	flag.BoolVar(&removeLocal, "removeLocal", false, "Remove files locally that have been deleted on the Duet")
+	flag.IntVar(&parallel, "parallel", duetbackup.DefaultParallelism, "Number of files to download in parallel")
+	flag.BoolVar(&checksum, "checksum", false, "Use a SHA1 checksum instead of mtime to detect changed files (requires firmware support for M38)")
+	flag.BoolVar(&restore, "restore", false, "Upload outDir to the Duet instead of downloading from it (-removeLocal then removes files on the Duet that no longer exist in outDir)")
+	flag.BoolVar(&bidirectional, "bidirectional", false, "Reconcile both sides instead of treating one as authoritative (see -conflict)")
+	flag.StringVar(&conflictPolicy, "conflict", string(duetbackup.ConflictNewerWins), "Conflict policy for -bidirectional: newer-wins, remote-wins, local-wins or rename-conflict")
 	flag.Var(&excls, "exclude", "Exclude paths starting with this string (can be passed multiple times)")
 	flag.Parse()
 
@@ -34,13 +43,21 @@ func main() {
 		log.Fatal("Invalid port", port)
 	}
 
-	rfm := librfm.New(domain, port)
+	if restore && bidirectional {
+		log.Fatal("-restore and -bidirectional are mutually exclusive")
+	}
+
+	// Cancel the running backup cleanly on Ctrl-C instead of leaving a half-written file
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rfm := rrffm.New(domain, port)
 
 	// Try to connect
 	if verbose {
 		log.Println("Trying to connect to Duet")
 	}
-	if err := rfm.Connect(password); err != nil {
+	if err := rfm.Connect(ctx, password); err != nil {
 		log.Println("Duet currently not available")
 		os.Exit(0)
 	}
@@ -53,7 +70,18 @@ func main() {
 	}
 
 	db := duetbackup.New(rfm, verbose)
-	if err = db.SyncFolder(duetbackup.CleanPath(dirToBackup), absPath, excls, removeLocal); err != nil {
+	db.Checksum = checksum
+
+	remoteDir := duetbackup.CleanPath(dirToBackup)
+	switch {
+	case bidirectional:
+		err = db.Reconcile(ctx, remoteDir, absPath, excls, duetbackup.ConflictPolicy(conflictPolicy))
+	case restore:
+		err = db.RestoreFolder(ctx, absPath, remoteDir, excls, removeLocal)
+	default:
+		err = db.SyncFolderN(ctx, remoteDir, absPath, excls, removeLocal, parallel)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,152 @@
+// Command rfm is a small command line client exposing raw RepRapFirmware
+// file operations (list, get, mkdir, move, delete, upload) through
+// rrffm.RRFFileManager. It is mainly useful for debugging a Duet's HTTP
+// file system interface without running a full backup.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/wilriker/rrffm"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: rfm -domain <domain> [-port <port>] [-password <password>] <command> [args...]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  ls <dir>             list files in dir")
+	fmt.Fprintln(os.Stderr, "  get <path> <outfile> download path to outfile")
+	fmt.Fprintln(os.Stderr, "  mkdir <dir>          create dir")
+	fmt.Fprintln(os.Stderr, "  mv <old> <new>       rename/move old to new")
+	fmt.Fprintln(os.Stderr, "  rm <path>            delete path")
+	fmt.Fprintln(os.Stderr, "  rmr [-n] <path>      delete path recursively (-n: print what would be removed instead)")
+	fmt.Fprintln(os.Stderr, "  put <path> <infile>  upload infile to path")
+}
+
+func main() {
+	var domain, password string
+	var port uint64
+	var allowDangerous bool
+
+	flag.StringVar(&domain, "domain", "", "Domain of Duet Wifi")
+	flag.Uint64Var(&port, "port", 80, "Port of Duet Wifi")
+	flag.StringVar(&password, "password", "reprap", "Connection password")
+	flag.BoolVar(&allowDangerous, "allow-dangerous", false, "Allow rmr to remove 0:/ or 0:/sys")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if domain == "" || len(args) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if port > 65535 {
+		log.Fatal("Invalid port", port)
+	}
+
+	// Cancel an in-flight command cleanly on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var opts []rrffm.Option
+	if allowDangerous {
+		opts = append(opts, rrffm.WithAllowDangerous())
+	}
+	rfm := rrffm.New(domain, port, opts...)
+	if err := rfm.Connect(ctx, password); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := run(ctx, rfm, args[0], args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, rfm rrffm.RRFFileManager, command string, args []string) error {
+	switch command {
+	case "ls":
+		if len(args) != 1 {
+			return fmt.Errorf("ls requires exactly one argument")
+		}
+		fl, err := rfm.GetFilelist(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		for _, f := range fl.Files {
+			fmt.Println(f.Name)
+		}
+		return nil
+	case "get":
+		if len(args) != 2 {
+			return fmt.Errorf("get requires exactly two arguments")
+		}
+		rc, _, err := rfm.GetFile(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		out, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, rc)
+		return err
+	case "put":
+		if len(args) != 2 {
+			return fmt.Errorf("put requires exactly two arguments")
+		}
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return rfm.Upload(ctx, args[0], f, fi.Size(), fi.ModTime())
+	case "mkdir":
+		if len(args) != 1 {
+			return fmt.Errorf("mkdir requires exactly one argument")
+		}
+		return rfm.Mkdir(ctx, args[0])
+	case "mv":
+		if len(args) != 2 {
+			return fmt.Errorf("mv requires exactly two arguments")
+		}
+		return rfm.Move(ctx, args[0], args[1])
+	case "rm":
+		if len(args) != 1 {
+			return fmt.Errorf("rm requires exactly one argument")
+		}
+		return rfm.Delete(ctx, args[0])
+	case "rmr":
+		if len(args) == 2 && args[0] == "-n" {
+			paths, err := rfm.DeleteRecursiveDryRun(ctx, args[1])
+			if err != nil {
+				return err
+			}
+			for _, p := range paths {
+				fmt.Println(p)
+			}
+			return nil
+		}
+		if len(args) != 1 {
+			return fmt.Errorf("rmr requires exactly one argument")
+		}
+		return rfm.DeleteRecursive(ctx, args[0])
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
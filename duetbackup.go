@@ -1,52 +1,69 @@
-package main
+package duetbackup
 
 import (
-	"flag"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/wilriker/rrffm"
 )
 
 const (
-	sysDir    = "0:/sys"
+	// SysDir is the default directory on the Duet to back up
+	SysDir    = "0:/sys"
 	dirMarker = ".duetbackup"
 )
 
-var rfm rrffm.RRFFileManager
 var multiSlashRegex = regexp.MustCompile(`/{2,}`)
 
-type excludes struct {
-	excls []string
+// DuetBackup synchronizes the contents of a directory on a Duet board
+// running RepRapFirmware to a local directory.
+type DuetBackup struct {
+	rfm     rrffm.RRFFileManager
+	verbose bool
+
+	// ProgressInterval controls how often SyncFolderN logs aggregate
+	// transfer progress when verbose is set. It defaults to
+	// defaultProgressInterval when left zero.
+	ProgressInterval time.Duration
+
+	// Checksum enables hash-based change detection: instead of trusting the
+	// RRF-reported mtime (which carries no timezone and is vulnerable to
+	// clock drift) it compares a SHA1 of the remote file, computed by the
+	// firmware via M38, against one of the local file. It falls back to
+	// size+mtime when the firmware does not support M38.
+	Checksum bool
 }
 
-func (e *excludes) String() string {
-	return strings.Join(e.excls, ",")
-}
-
-func (e *excludes) Set(value string) error {
-	e.excls = append(e.excls, cleanPath(value))
-	return nil
+// New creates a new DuetBackup operating through rfm. If verbose is true
+// it will log details about every file it looks at.
+func New(rfm rrffm.RRFFileManager, verbose bool) *DuetBackup {
+	return &DuetBackup{
+		rfm:     rfm,
+		verbose: verbose,
+	}
 }
 
-// Contains checks if the given path starts with any of the known excludes
-func (e *excludes) Contains(path string) bool {
-	for _, excl := range e.excls {
-		if strings.HasPrefix(path, excl) {
-			return true
-		}
+func (db *DuetBackup) progressInterval() time.Duration {
+	if db.ProgressInterval <= 0 {
+		return defaultProgressInterval
 	}
-	return false
+	return db.ProgressInterval
 }
 
-// cleanPath will reduce multiple consecutive slashes into one and
+// CleanPath will reduce multiple consecutive slashes into one and
 // then remove a trailing slash if any.
-func cleanPath(path string) string {
+func CleanPath(path string) string {
 	cleanedPath := multiSlashRegex.ReplaceAllString(path, "/")
 	cleanedPath = strings.TrimSuffix(cleanedPath, "/")
 	return cleanedPath
@@ -54,7 +71,7 @@ func cleanPath(path string) string {
 
 // ensureOutDirExists will create the local directory if it does not exist
 // and will in any case create the marker file inside it
-func ensureOutDirExists(outDir string, verbose bool) error {
+func (db *DuetBackup) ensureOutDirExists(outDir string) error {
 	path, err := filepath.Abs(outDir)
 	if err != nil {
 		return err
@@ -68,7 +85,7 @@ func ensureOutDirExists(outDir string, verbose bool) error {
 
 	// Create the directory
 	if fi == nil {
-		if verbose {
+		if db.verbose {
 			log.Println("  Creating directory", path)
 		}
 		if err = os.MkdirAll(path, 0755); err != nil {
@@ -86,9 +103,9 @@ func ensureOutDirExists(outDir string, verbose bool) error {
 	return nil
 }
 
-func updateLocalFiles(fl *rrffm.Filelist, outDir string, excls excludes, removeLocal, verbose bool) error {
+func (db *DuetBackup) updateLocalFiles(ctx context.Context, fl *rrffm.Filelist, outDir string, excls Excludes, removeLocal bool) error {
 
-	if err := ensureOutDirExists(outDir, verbose); err != nil {
+	if err := db.ensureOutDirExists(outDir); err != nil {
 		return err
 	}
 
@@ -100,7 +117,7 @@ func updateLocalFiles(fl *rrffm.Filelist, outDir string, excls excludes, removeL
 
 		// Skip files covered by an exclude pattern
 		if excls.Contains(remoteFilename) {
-			if verbose {
+			if db.verbose {
 				log.Println("  Excluding: ", remoteFilename)
 			}
 			continue
@@ -112,17 +129,18 @@ func updateLocalFiles(fl *rrffm.Filelist, outDir string, excls excludes, removeL
 			return err
 		}
 
-		// File does not exist or is outdated so get it
-		if fi == nil || fi.ModTime().Before(file.Date()) {
-			if verbose {
-			}
+		outdated, remoteHash, err := db.needsUpdate(ctx, remoteFilename, fileName, file.Size, file.Date(), fi)
+		if err != nil {
+			return err
+		}
 
-			// Download file
-			body, duration, err := rfm.Download(remoteFilename)
+		// File does not exist or is outdated so get it
+		if outdated {
+			duration, err := db.downloadAndWrite(ctx, remoteFilename, fileName, file.Date(), remoteHash)
 			if err != nil {
 				return err
 			}
-			if verbose {
+			if db.verbose {
 				kibs := (float64(file.Size) / duration.Seconds()) / 1024
 				if fi != nil {
 					log.Printf("  Updated:   %s (%.1f KiB/s)", remoteFilename, kibs)
@@ -130,24 +148,8 @@ func updateLocalFiles(fl *rrffm.Filelist, outDir string, excls excludes, removeL
 					log.Printf("  Added:     %s (%.1f KiB/s)", remoteFilename, kibs)
 				}
 			}
-
-			// Open or create corresponding local file
-			nf, err := os.Create(fileName)
-			if err != nil {
-				return err
-			}
-			defer nf.Close()
-
-			// Write contents to local file
-			_, err = nf.Write(body)
-			if err != nil {
-				return err
-			}
-
-			// Adjust mtime
-			os.Chtimes(fileName, file.Date(), file.Date())
 		} else {
-			if verbose {
+			if db.verbose {
 				log.Println("  Up-to-date:", remoteFilename)
 			}
 		}
@@ -157,6 +159,117 @@ func updateLocalFiles(fl *rrffm.Filelist, outDir string, excls excludes, removeL
 	return nil
 }
 
+// downloadAndWrite streams remoteFilename into a temporary file next to
+// fileName and renames it into place only once the transfer has fully
+// succeeded, adjusting its mtime to date beforehand. This keeps a
+// cancelled or failed download (e.g. Ctrl-C mid-transfer) from leaving a
+// truncated fileName behind with a fresh mtime, which would otherwise look
+// up-to-date to needsUpdate and never get retried. It returns how long the
+// download itself took. If expectHash is non-empty, the downloaded content
+// is hashed on the fly via an io.TeeReader and compared against it, so that
+// checking the transfer's integrity does not require re-reading the file
+// off disk.
+func (db *DuetBackup) downloadAndWrite(ctx context.Context, remoteFilename, fileName string, date time.Time, expectHash string) (*time.Duration, error) {
+	rc, _, err := db.rfm.GetFile(ctx, remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	nf, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	tmpName := nf.Name()
+	defer func() {
+		nf.Close()
+		os.Remove(tmpName)
+	}()
+
+	var r io.Reader = rc
+	var h hash.Hash
+	if expectHash != "" {
+		h = sha1.New()
+		r = io.TeeReader(rc, h)
+	}
+
+	start := time.Now()
+	if _, err = io.Copy(nf, r); err != nil {
+		return nil, err
+	}
+	duration := time.Since(start)
+
+	if h != nil {
+		if got := hex.EncodeToString(h.Sum(nil)); got != expectHash {
+			return &duration, fmt.Errorf("checksum mismatch downloading %s: got %s, want %s", remoteFilename, got, expectHash)
+		}
+	}
+
+	if err := nf.Close(); err != nil {
+		return &duration, err
+	}
+	if err := os.Chtimes(tmpName, date, date); err != nil {
+		return &duration, err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return &duration, err
+	}
+
+	return &duration, nil
+}
+
+// needsUpdate decides whether remoteFilename needs to be (re-)downloaded to
+// fileName. fi is the local FileInfo, or nil if the file does not exist yet.
+// When db.Checksum is set it asks the firmware for a SHA1 of the remote file
+// and compares it against one computed locally, falling back to a size and
+// mtime comparison when the firmware does not support it. The second return
+// value is the remote hash when one was obtained, so callers can pass it on
+// to downloadAndWrite to verify the transfer without fetching it again.
+func (db *DuetBackup) needsUpdate(ctx context.Context, remoteFilename, fileName string, remoteSize uint64, remoteDate time.Time, fi os.FileInfo) (bool, string, error) {
+	if fi == nil {
+		return true, "", nil
+	}
+
+	if !db.Checksum {
+		return fi.ModTime().Before(remoteDate), "", nil
+	}
+
+	remoteHash, err := db.rfm.GetFileHash(ctx, remoteFilename)
+	if err != nil {
+		// A cancelled/timed-out context is not "the firmware doesn't support
+		// M38" - it must abort the sync like every other ctx-aware call
+		// here, not get masked by the fallback below.
+		if ctx.Err() != nil {
+			return false, "", err
+		}
+		if db.verbose {
+			log.Println("  Firmware does not support checksums, falling back to size/mtime for", remoteFilename)
+		}
+		return uint64(fi.Size()) != remoteSize || fi.ModTime().Before(remoteDate), "", nil
+	}
+
+	localHash, err := sha1File(fileName)
+	if err != nil {
+		return false, "", err
+	}
+	return localHash != remoteHash, remoteHash, nil
+}
+
+// sha1File returns the lowercase hex SHA1 hash of the local file at path.
+func sha1File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // isManagedDirectory checks wether the given path is a directory and
 // if so if it contains the marker file. It will return false in case
 // any error has occured.
@@ -175,7 +288,7 @@ func isManagedDirectory(basePath string, f os.FileInfo) bool {
 	return true
 }
 
-func removeDeletedFiles(fl *rrffm.Filelist, outDir string, verbose bool) error {
+func (db *DuetBackup) removeDeletedFiles(fl *rrffm.Filelist, outDir string) error {
 
 	// Pseudo hash-set of known remote filenames
 	existingFiles := make(map[string]struct{})
@@ -198,7 +311,7 @@ func removeDeletedFiles(fl *rrffm.Filelist, outDir string, verbose bool) error {
 			if err := os.RemoveAll(filepath.Join(outDir, f.Name())); err != nil {
 				return err
 			}
-			if verbose {
+			if db.verbose {
 				log.Println("  Removed:   ", f.Name())
 			}
 		}
@@ -207,7 +320,14 @@ func removeDeletedFiles(fl *rrffm.Filelist, outDir string, verbose bool) error {
 	return nil
 }
 
-func syncFolder(folder, outDir string, excls excludes, removeLocal, verbose bool) error {
+// SyncFolder recursively downloads all new or changed files from folder on
+// the Duet into outDir, optionally removing local files that no longer
+// exist remotely. It aborts as soon as ctx is cancelled.
+func (db *DuetBackup) SyncFolder(ctx context.Context, folder, outDir string, excls Excludes, removeLocal bool) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// Skip complete directories if they are covered by an exclude pattern
 	if excls.Contains(folder) {
@@ -216,19 +336,19 @@ func syncFolder(folder, outDir string, excls excludes, removeLocal, verbose bool
 	}
 
 	log.Println("Fetching filelist for", folder)
-	fl, err := rfm.Filelist(folder)
+	fl, err := db.rfm.GetFilelist(ctx, folder)
 	if err != nil {
 		return err
 	}
 
 	log.Println("Downloading new/changed files from", folder, "to", outDir)
-	if err = updateLocalFiles(fl, outDir, excls, removeLocal, verbose); err != nil {
+	if err = db.updateLocalFiles(ctx, fl, outDir, excls, removeLocal); err != nil {
 		return err
 	}
 
 	if removeLocal {
 		log.Println("Removing no longer existing files in", outDir)
-		if err = removeDeletedFiles(fl, outDir, verbose); err != nil {
+		if err = db.removeDeletedFiles(fl, outDir); err != nil {
 			return err
 		}
 	}
@@ -240,58 +360,10 @@ func syncFolder(folder, outDir string, excls excludes, removeLocal, verbose bool
 		}
 		remoteFilename := fmt.Sprintf("%s/%s", fl.Dir, file.Name)
 		fileName := filepath.Join(outDir, file.Name)
-		if err = syncFolder(remoteFilename, fileName, excls, removeLocal, verbose); err != nil {
+		if err = db.SyncFolder(ctx, remoteFilename, fileName, excls, removeLocal); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
-
-func main() {
-	var domain, dirToBackup, outDir, password string
-	var removeLocal, verbose bool
-	var port uint64
-	var excls excludes
-
-	flag.StringVar(&domain, "domain", "", "Domain of Duet Wifi")
-	flag.Uint64Var(&port, "port", 80, "Port of Duet Wifi")
-	flag.StringVar(&dirToBackup, "dirToBackup", sysDir, "Directory on Duet to create a backup of")
-	flag.StringVar(&outDir, "outDir", "", "Output dir of backup")
-	flag.StringVar(&password, "password", "reprap", "Connection password")
-	flag.BoolVar(&removeLocal, "removeLocal", false, "Remove files locally that have been deleted on the Duet")
-	flag.BoolVar(&verbose, "verbose", false, "Output more details")
-	flag.Var(&excls, "exclude", "Exclude paths starting with this string (can be passed multiple times)")
-	flag.Parse()
-
-	if domain == "" || outDir == "" {
-		log.Fatal("-domain and -outDir are mandatory parameters")
-	}
-
-	if port > 65535 {
-		log.Fatal("Invalid port", port)
-	}
-
-	rfm = rrffm.New(domain, port)
-
-	// Try to connect
-	if verbose {
-		log.Println("Trying to connect to Duet")
-	}
-	if err := rfm.Connect(password); err != nil {
-		log.Fatal(err)
-		log.Println("Duet currently not available")
-		os.Exit(0)
-	}
-
-	// Get absolute path from user's input
-	absPath, err := filepath.Abs(outDir)
-	if err != nil {
-		// Fall back to original user's input
-		absPath = outDir
-	}
-
-	if err = syncFolder(cleanPath(dirToBackup), absPath, excls, removeLocal, verbose); err != nil {
-		log.Fatal(err)
-	}
-}
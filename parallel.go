@@ -0,0 +1,212 @@
+package duetbackup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultParallelism is a conservative default for SyncFolderN since a
+// single Duet's HTTP stack tends to be fragile under concurrent requests.
+const DefaultParallelism = 2
+
+// downloadJob describes a single file queued for download by SyncFolderN.
+type downloadJob struct {
+	remoteFilename string
+	fileName       string
+	size           uint64
+	date           time.Time
+	existed        bool
+	hash           string
+}
+
+// SyncFolderN behaves like SyncFolder but downloads up to parallelism files
+// concurrently against the same RRF host. It first walks the remote tree
+// (sequentially, as directory listings are cheap) to build the full list of
+// files to fetch, then hands the downloads to a bounded worker pool,
+// reporting aggregate progress while verbose is set.
+func (db *DuetBackup) SyncFolderN(ctx context.Context, folder, outDir string, excls Excludes, removeLocal bool, parallelism int) error {
+	if parallelism < 1 {
+		parallelism = DefaultParallelism
+	}
+
+	jobs, err := db.collectJobs(ctx, folder, outDir, excls, removeLocal)
+	if err != nil {
+		return err
+	}
+
+	p := newProgress(len(jobs))
+	for _, job := range jobs {
+		p.addTotalBytes(job.size)
+	}
+
+	var reportDone chan struct{}
+	if db.verbose {
+		reportDone = make(chan struct{})
+		go p.report(reportDone, db.progressInterval())
+	}
+
+	err = db.runJobs(ctx, jobs, parallelism, p)
+
+	if reportDone != nil {
+		close(reportDone)
+	}
+
+	return err
+}
+
+// collectJobs walks folder the same way SyncFolder does, but instead of
+// downloading files immediately it collects them into a job list so they can
+// be fetched by a worker pool afterwards. Directory-level bookkeeping
+// (creating the output directory, pruning locally deleted files) still
+// happens inline since it is cheap and must happen in tree order.
+func (db *DuetBackup) collectJobs(ctx context.Context, folder, outDir string, excls Excludes, removeLocal bool) ([]downloadJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if excls.Contains(folder) {
+		log.Println("Excluding", folder)
+		return nil, nil
+	}
+
+	log.Println("Fetching filelist for", folder)
+	fl, err := db.rfm.GetFilelist(ctx, folder)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.ensureOutDirExists(outDir); err != nil {
+		return nil, err
+	}
+
+	var jobs []downloadJob
+	for _, file := range fl.Files {
+		if file.IsDir() {
+			continue
+		}
+		remoteFilename := fmt.Sprintf("%s/%s", fl.Dir, file.Name)
+
+		if excls.Contains(remoteFilename) {
+			if db.verbose {
+				log.Println("  Excluding: ", remoteFilename)
+			}
+			continue
+		}
+
+		fileName := filepath.Join(outDir, file.Name)
+		fi, err := os.Stat(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		outdated, remoteHash, err := db.needsUpdate(ctx, remoteFilename, fileName, file.Size, file.Date(), fi)
+		if err != nil {
+			return nil, err
+		}
+
+		if outdated {
+			jobs = append(jobs, downloadJob{
+				remoteFilename: remoteFilename,
+				fileName:       fileName,
+				size:           file.Size,
+				date:           file.Date(),
+				existed:        fi != nil,
+				hash:           remoteHash,
+			})
+		} else if db.verbose {
+			log.Println("  Up-to-date:", remoteFilename)
+		}
+	}
+
+	if removeLocal {
+		log.Println("Removing no longer existing files in", outDir)
+		if err := db.removeDeletedFiles(fl, outDir); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, file := range fl.Files {
+		if !file.IsDir() {
+			continue
+		}
+		remoteFilename := fmt.Sprintf("%s/%s", fl.Dir, file.Name)
+		fileName := filepath.Join(outDir, file.Name)
+		subJobs, err := db.collectJobs(ctx, remoteFilename, fileName, excls, removeLocal)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, subJobs...)
+	}
+
+	return jobs, nil
+}
+
+// runJobs fans jobs out to parallelism workers, stopping as soon as one of
+// them fails or ctx is cancelled. A job failure cancels a context derived
+// from ctx so the producer loop below is woken up and stops feeding jobCh
+// even if every worker has already returned; without that, a worker exiting
+// on its own first error rather than draining jobCh can leave the producer
+// blocked on jobCh forever.
+func (db *DuetBackup) runJobs(ctx context.Context, jobs []downloadJob, parallelism int, p *progress) error {
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobCh := make(chan downloadJob)
+	errCh := make(chan error, parallelism)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobCh {
+				if err := db.runJob(workerCtx, job, p); err != nil {
+					errCh <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, job := range jobs {
+		select {
+		case jobCh <- job:
+		case <-workerCtx.Done():
+			break feed
+		}
+	}
+	close(jobCh)
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (db *DuetBackup) runJob(ctx context.Context, job downloadJob, p *progress) error {
+	duration, err := db.downloadAndWrite(ctx, job.remoteFilename, job.fileName, job.date, job.hash)
+	if err != nil {
+		return err
+	}
+	if db.verbose {
+		kibs := (float64(job.size) / duration.Seconds()) / 1024
+		if job.existed {
+			log.Printf("  Updated:   %s (%.1f KiB/s)", job.remoteFilename, kibs)
+		} else {
+			log.Printf("  Added:     %s (%.1f KiB/s)", job.remoteFilename, kibs)
+		}
+	}
+	p.fileDone(job.size)
+	return nil
+}
@@ -0,0 +1,68 @@
+package duetbackup
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultProgressInterval is how often progress is logged when -verbose is set.
+const defaultProgressInterval = 5 * time.Second
+
+// progress tracks aggregate transfer statistics for a running sync, similar
+// to rclone's transfer stats: files done/total, bytes done/total and the
+// aggregate throughput since the sync started.
+type progress struct {
+	mu         sync.Mutex
+	filesTotal int
+	filesDone  int
+	bytesTotal uint64
+	bytesDone  uint64
+	start      time.Time
+}
+
+func newProgress(filesTotal int) *progress {
+	return &progress{
+		filesTotal: filesTotal,
+		start:      time.Now(),
+	}
+}
+
+func (p *progress) addTotalBytes(n uint64) {
+	p.mu.Lock()
+	p.bytesTotal += n
+	p.mu.Unlock()
+}
+
+func (p *progress) fileDone(bytes uint64) {
+	p.mu.Lock()
+	p.filesDone++
+	p.bytesDone += bytes
+	p.mu.Unlock()
+}
+
+func (p *progress) snapshot() (filesDone, filesTotal int, bytesDone, bytesTotal uint64, kibs float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		kibs = (float64(p.bytesDone) / elapsed) / 1024
+	}
+	return p.filesDone, p.filesTotal, p.bytesDone, p.bytesTotal, kibs
+}
+
+// report logs a progress line every interval until done is closed.
+func (p *progress) report(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			filesDone, filesTotal, bytesDone, bytesTotal, kibs := p.snapshot()
+			log.Printf("  Progress: %d/%d files, %.1f/%.1f MiB, %.1f KiB/s",
+				filesDone, filesTotal, float64(bytesDone)/1024/1024, float64(bytesTotal)/1024/1024, kibs)
+		case <-done:
+			return
+		}
+	}
+}
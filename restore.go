@@ -0,0 +1,179 @@
+package duetbackup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/wilriker/rrffm"
+)
+
+// remoteInfo is the subset of a remote file's metadata needed for
+// bidirectional comparisons, kept independent of rrffm's unexported file type.
+type remoteInfo struct {
+	size  uint64
+	date  time.Time
+	isDir bool
+}
+
+func remoteInfoMap(fl *rrffm.Filelist) map[string]remoteInfo {
+	m := make(map[string]remoteInfo, len(fl.Files))
+	for _, f := range fl.Files {
+		m[f.Name] = remoteInfo{size: f.Size, date: f.Date(), isDir: f.IsDir()}
+	}
+	return m
+}
+
+// RestoreFolder walks localDir (typically a tree previously produced by
+// SyncFolder) and uploads any file that is missing or newer on the local
+// side to remoteDir on the Duet, optionally removing remote files that no
+// longer exist locally. This is the inverse of SyncFolder, useful for
+// migrating a backed-up configuration to a (new) Duet board.
+func (db *DuetBackup) RestoreFolder(ctx context.Context, localDir, remoteDir string, excls Excludes, removeRemote bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if excls.Contains(remoteDir) {
+		log.Println("Excluding", remoteDir)
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+
+	fl, err := db.rfm.GetFilelist(ctx, remoteDir)
+	if err != nil {
+		// A cancelled/timed-out context isn't "the directory doesn't exist
+		// yet" - surface it instead of masking it behind a Mkdir attempt.
+		if ctx.Err() != nil {
+			return err
+		}
+		if mkErr := db.rfm.Mkdir(ctx, remoteDir); mkErr != nil {
+			return mkErr
+		}
+		fl = &rrffm.Filelist{Dir: remoteDir}
+	}
+	remote := remoteInfoMap(fl)
+
+	log.Println("Uploading new/changed files from", localDir, "to", remoteDir)
+	for _, entry := range entries {
+		if entry.Name() == dirMarker {
+			continue
+		}
+
+		remoteFilename := fmt.Sprintf("%s/%s", remoteDir, entry.Name())
+		if excls.Contains(remoteFilename) {
+			if db.verbose {
+				log.Println("  Excluding: ", remoteFilename)
+			}
+			continue
+		}
+
+		localPath := filepath.Join(localDir, entry.Name())
+
+		if entry.IsDir() {
+			if ri, exists := remote[entry.Name()]; !exists || !ri.isDir {
+				if err := db.rfm.Mkdir(ctx, remoteFilename); err != nil {
+					return err
+				}
+			}
+			if err := db.RestoreFolder(ctx, localPath, remoteFilename, excls, removeRemote); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if ri, exists := remote[entry.Name()]; exists && !ri.isDir {
+			outdated, remoteHash, err := db.needsUpdate(ctx, remoteFilename, localPath, ri.size, ri.date, entry)
+			if err != nil {
+				return err
+			}
+			// Without a hash, needsUpdate reports a newer remote copy; here it
+			// is a newer local copy (at RRF's whole-second precision) that needs
+			// uploading, plus a differing size in the checksum fallback.
+			if remoteHash == "" {
+				outdated = entry.ModTime().Truncate(time.Second).After(ri.date) ||
+					(db.Checksum && uint64(entry.Size()) != ri.size)
+			}
+			if !outdated {
+				if db.verbose {
+					log.Println("  Up-to-date:", remoteFilename)
+				}
+				continue
+			}
+		}
+
+		if err := db.uploadFile(ctx, localPath, remoteFilename, entry); err != nil {
+			return err
+		}
+	}
+
+	if removeRemote {
+		log.Println("Removing no longer existing files in", remoteDir)
+		if err := db.removeDeletedRemoteFiles(ctx, fl, entries); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uploadFile streams the local file at localPath to remoteFilename without
+// buffering it fully in memory.
+func (db *DuetBackup) uploadFile(ctx context.Context, localPath, remoteFilename string, fi os.FileInfo) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	if err := db.rfm.Upload(ctx, remoteFilename, f, fi.Size(), fi.ModTime()); err != nil {
+		return err
+	}
+	duration := time.Since(start)
+
+	if db.verbose {
+		kibs := (float64(fi.Size()) / duration.Seconds()) / 1024
+		log.Printf("  Uploaded:  %s (%.1f KiB/s)", remoteFilename, kibs)
+	}
+	return nil
+}
+
+// removeDeletedRemoteFiles deletes everything in fl that no longer has a
+// corresponding entry in localEntries.
+func (db *DuetBackup) removeDeletedRemoteFiles(ctx context.Context, fl *rrffm.Filelist, localEntries []os.FileInfo) error {
+	existingLocal := make(map[string]struct{}, len(localEntries))
+	for _, e := range localEntries {
+		existingLocal[e.Name()] = struct{}{}
+	}
+
+	for _, f := range fl.Files {
+		if _, exists := existingLocal[f.Name]; exists {
+			continue
+		}
+
+		remoteFilename := fmt.Sprintf("%s/%s", fl.Dir, f.Name)
+		var err error
+		if f.IsDir() {
+			err = db.rfm.DeleteRecursive(ctx, remoteFilename)
+		} else {
+			err = db.rfm.Delete(ctx, remoteFilename)
+		}
+		if err != nil {
+			return err
+		}
+		if db.verbose {
+			log.Println("  Removed:   ", remoteFilename)
+		}
+	}
+
+	return nil
+}
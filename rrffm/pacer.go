@@ -0,0 +1,65 @@
+package rrffm
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pacer implements a simple exponential backoff between retried requests,
+// similar to rclone's lib/pacer: it starts at minSleep and multiplies by
+// decay on every failure (capped at maxSleep), easing back down towards
+// minSleep again once requests start succeeding.
+type pacer struct {
+	mu       sync.Mutex
+	minSleep time.Duration
+	maxSleep time.Duration
+	decay    float64
+	sleep    time.Duration
+}
+
+func newPacer(minSleep, maxSleep time.Duration, decay float64) *pacer {
+	return &pacer{
+		minSleep: minSleep,
+		maxSleep: maxSleep,
+		decay:    decay,
+		sleep:    minSleep,
+	}
+}
+
+// wait blocks for the current backoff duration, or until ctx is cancelled.
+func (p *pacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	sleep := p.sleep
+	p.mu.Unlock()
+
+	t := time.NewTimer(sleep)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// increase lengthens the backoff after a failed attempt.
+func (p *pacer) increase() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sleep = time.Duration(float64(p.sleep) * p.decay)
+	if p.sleep > p.maxSleep {
+		p.sleep = p.maxSleep
+	}
+}
+
+// decrease shortens the backoff again after a successful attempt.
+func (p *pacer) decrease() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sleep = time.Duration(float64(p.sleep) / p.decay)
+	if p.sleep < p.minSleep {
+		p.sleep = p.minSleep
+	}
+}
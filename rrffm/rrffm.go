@@ -1,15 +1,18 @@
 package rrffm
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,74 +24,144 @@ const (
 	moveURL         = "%s/rr_move?old=%s&new=%s"
 	uploadURL       = "%s/rr_upload?name=%s&time=%s"
 	deleteURL       = "%s/rr_delete?name=%s"
+	gcodeURL        = "%s/rr_gcode?gcode=%s"
+	replyURL        = "%s/rr_reply"
 	typeDirectory   = "d"
 	typeFile        = "f"
 	noErrorResponse = `{"err":0}`
 	// TimeFormat is the format of timestamps used by RRF
 	TimeFormat = "2006-01-02T15:04:05"
+
+	// defaultRetries is how many times a failed request is retried by default.
+	defaultRetries = 3
+	// defaultMinSleep, defaultMaxSleep and defaultDecay configure the
+	// default exponential backoff between retries.
+	defaultMinSleep = 100 * time.Millisecond
+	defaultMaxSleep = 2 * time.Second
+	defaultDecay    = 2.0
 )
 
+// sha1HashRegex matches the plain hex SHA1 hash M38 writes to rr_reply. Older
+// firmwares without M38 support reply with an error message instead, which
+// will simply fail to match.
+var sha1HashRegex = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+
 // RRFFileManager provides means to interact with SD card contents on a machine
 // using RepRapFirmware (RRF). It will communicate through its HTTP interface.
+// Every method takes a context.Context so a caller can abort or time out an
+// in-flight request, e.g. on SIGINT or via context.WithTimeout.
 type RRFFileManager interface {
 	// Connect establishes a connection to RepRapFirmware
-	Connect(password string) error
+	Connect(ctx context.Context, password string) error
 
 	// GetFilelist will download a list of all files (also including directories) for the given path
-	GetFilelist(path string) (*Filelist, error)
+	GetFilelist(ctx context.Context, path string) (*Filelist, error)
 
-	// GetFile downloads a file with the given path also returning the duration of this action
-	GetFile(filepath string) ([]byte, *time.Duration, error)
+	// GetFile opens a file with the given path for streaming download. The
+	// caller is responsible for closing the returned io.ReadCloser. The
+	// second return value is the file's size as reported by the server, or
+	// -1 if it did not report one.
+	GetFile(ctx context.Context, filepath string) (io.ReadCloser, int64, error)
+
+	// GetFileHash returns the lowercase hex SHA1 hash of the file at path as
+	// computed by the firmware via M38, without transferring its contents.
+	// It returns an error if the firmware does not support M38.
+	GetFileHash(ctx context.Context, path string) (string, error)
 
 	// Mkdir creates a new directory with the given path
-	Mkdir(path string) error
+	Mkdir(ctx context.Context, path string) error
 
 	// Move renames or moves a file or directory (only within the same SD card)
-	Move(oldpath, newpath string) error
+	Move(ctx context.Context, oldpath, newpath string) error
 
 	// MoveOverwrite will delete the target file first and thus overwriting it
-	MoveOverwrite(oldpath, newpath string) error
+	MoveOverwrite(ctx context.Context, oldpath, newpath string) error
 
 	// Delete removes the given path. It will fail for non-empty directories.
-	Delete(path string) error
+	Delete(ctx context.Context, path string) error
 
 	// DeleteRecursive removes the given path recursively. This will also delete directories with all their contents.
-	DeleteRecursive(path string) error
+	// It refuses to touch "0:/" or "0:/sys" unless the AllowDangerous option was passed to New.
+	DeleteRecursive(ctx context.Context, path string) error
+
+	// DeleteRecursiveDryRun reports the paths DeleteRecursive would remove
+	// for path, in removal order, without deleting anything.
+	DeleteRecursiveDryRun(ctx context.Context, path string) ([]string, error)
 
-	// Upload uploads a new file to the given path on the SD card
-	Upload(path string, content []byte) (*time.Duration, error)
+	// Upload streams size bytes read from r to the given path on the SD
+	// card, setting its timestamp to mtime. It does not buffer r in memory.
+	Upload(ctx context.Context, path string, r io.Reader, size int64, mtime time.Time) error
 }
 
 type rrffm struct {
-	httpClient *http.Client
-	baseURL    string
+	httpClient     *http.Client
+	baseURL        string
+	retries        int
+	pacer          *pacer
+	allowDangerous bool
+}
+
+// Option configures optional behavior of an RRFFileManager created via New.
+type Option func(*rrffm)
+
+// WithRetries sets how many times a failed request is retried before giving up.
+func WithRetries(n int) Option {
+	return func(r *rrffm) {
+		r.retries = n
+	}
+}
+
+// WithPacer configures the exponential backoff pacer used between retries:
+// it starts at min, doubles (or whatever decay is) on every failure up to
+// max, and eases back down towards min again as requests start succeeding.
+func WithPacer(min, max time.Duration, decay float64) Option {
+	return func(r *rrffm) {
+		r.pacer = newPacer(min, max, decay)
+	}
+}
+
+// WithAllowDangerous allows DeleteRecursive to remove a path in
+// protectedPaths ("0:/" or "0:/sys"), which it otherwise refuses to do.
+func WithAllowDangerous() Option {
+	return func(r *rrffm) {
+		r.allowDangerous = true
+	}
 }
 
-// New creates a new instance of RRFFileManager
-func New(domain string, port uint64) RRFFileManager {
+// New creates a new instance of RRFFileManager. By default it retries failed
+// requests up to 3 times with an exponential backoff between 100ms and 2s,
+// which in practice is needed since RRF's HTTP stack frequently drops or
+// truncates responses on flaky WiFi links.
+func New(domain string, port uint64, opts ...Option) RRFFileManager {
 	tr := &http.Transport{DisableCompression: true}
-	return &rrffm{
+	r := &rrffm{
 		httpClient: &http.Client{Transport: tr},
 		baseURL:    "http://" + domain + ":" + strconv.FormatUint(port, 10),
+		retries:    defaultRetries,
+		pacer:      newPacer(defaultMinSleep, defaultMaxSleep, defaultDecay),
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 func (rrffm *rrffm) getTimestamp(time time.Time) string {
 	return time.Format(TimeFormat)
 }
 
-func (rrffm *rrffm) Connect(password string) error {
-	_, _, err := rrffm.doGetRequest(fmt.Sprintf(connectURL, rrffm.baseURL, url.QueryEscape(password), url.QueryEscape(rrffm.getTimestamp(time.Now()))))
+func (rrffm *rrffm) Connect(ctx context.Context, password string) error {
+	_, _, err := rrffm.doGetRequest(ctx, fmt.Sprintf(connectURL, rrffm.baseURL, url.QueryEscape(password), url.QueryEscape(rrffm.getTimestamp(time.Now()))))
 	return err
 }
 
-func (rrffm *rrffm) GetFilelist(dir string) (*Filelist, error) {
-	return rrffm.getFileListRecursively(url.QueryEscape(dir), 0)
+func (rrffm *rrffm) GetFilelist(ctx context.Context, dir string) (*Filelist, error) {
+	return rrffm.getFileListRecursively(ctx, url.QueryEscape(dir), 0)
 }
 
-func (rrffm *rrffm) getFileListRecursively(dir string, first uint64) (*Filelist, error) {
+func (rrffm *rrffm) getFileListRecursively(ctx context.Context, dir string, first uint64) (*Filelist, error) {
 
-	body, _, err := rrffm.doGetRequest(fmt.Sprintf(fileListURL, rrffm.baseURL, dir))
+	body, _, err := rrffm.doGetRequest(ctx, fmt.Sprintf(fileListURL, rrffm.baseURL, dir))
 	if err != nil {
 		return nil, err
 	}
@@ -101,7 +174,7 @@ func (rrffm *rrffm) getFileListRecursively(dir string, first uint64) (*Filelist,
 
 	// If the response signals there is more to fetch do it recursively
 	if fl.next > 0 {
-		moreFiles, err := rrffm.getFileListRecursively(dir, fl.next)
+		moreFiles, err := rrffm.getFileListRecursively(ctx, dir, fl.next)
 		if err != nil {
 			return nil, err
 		}
@@ -122,37 +195,99 @@ func (rrffm *rrffm) getFileListRecursively(dir string, first uint64) (*Filelist,
 	return &fl, nil
 }
 
-func (rrffm *rrffm) GetFile(filepath string) ([]byte, *time.Duration, error) {
-	return rrffm.doGetRequest(fmt.Sprintf(fileDownloadURL, rrffm.baseURL, url.QueryEscape(filepath)))
+func (rrffm *rrffm) GetFile(ctx context.Context, filepath string) (io.ReadCloser, int64, error) {
+	return rrffm.doGetRequestStream(ctx, fmt.Sprintf(fileDownloadURL, rrffm.baseURL, url.QueryEscape(filepath)))
 }
 
-// download will perform a GET request on the given URL and return
-// the content of the response, a duration on how long it took (including
-// setup of connection) or an error in case something went wrong
-func (rrffm *rrffm) doGetRequest(url string) ([]byte, *time.Duration, error) {
-	start := time.Now()
-	resp, err := rrffm.httpClient.Get(url)
-	if err != nil {
-		return nil, nil, err
+func (rrffm *rrffm) GetFileHash(ctx context.Context, path string) (string, error) {
+	gcode := fmt.Sprintf(`M38 "%s"`, path)
+	if _, _, err := rrffm.doGetRequest(ctx, fmt.Sprintf(gcodeURL, rrffm.baseURL, url.QueryEscape(gcode))); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	duration := time.Since(start)
+	body, _, err := rrffm.doGetRequest(ctx, fmt.Sprintf(replyURL, rrffm.baseURL))
 	if err != nil {
-		return nil, nil, err
+		return "", err
 	}
-	return body, &duration, nil
+
+	hash := strings.ToLower(strings.TrimSpace(string(body)))
+	if !sha1HashRegex.MatchString(hash) {
+		return "", fmt.Errorf("firmware did not return a SHA1 hash for %s: %q", path, hash)
+	}
+	return hash, nil
 }
 
-func (rrffm *rrffm) doPostRequest(url string, content []byte) ([]byte, *time.Duration, error) {
+// doGetRequest will perform a GET request on the given URL and return
+// the content of the response, a duration on how long it took (including
+// setup of connection) or an error in case something went wrong. The
+// request is bound to ctx, so it is aborted as soon as ctx is cancelled.
+// It is retried with an exponential backoff on network errors and HTTP 5xx
+// responses, both of which are common on a Duet's flaky HTTP stack.
+func (rrffm *rrffm) doGetRequest(ctx context.Context, url string) ([]byte, *time.Duration, error) {
+	return rrffm.withRetry(ctx, func() ([]byte, *time.Duration, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rrffm.doRequest(req)
+	})
+}
+
+// doGetRequestStream behaves like doGetRequest but hands the response body
+// back to the caller as a stream instead of buffering it in memory, which
+// matters for downloading multi-megabyte G-code files. Retries therefore
+// only cover establishing the connection and reading the headers; a failure
+// while the caller is reading the body is surfaced to them directly instead
+// of being retried here.
+func (rrffm *rrffm) doGetRequestStream(ctx context.Context, rawURL string) (io.ReadCloser, int64, error) {
+	var lastErr error
+	for attempt := 0; attempt <= rrffm.retries; attempt++ {
+		if attempt > 0 {
+			if err := rrffm.pacer.wait(ctx); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		resp, err := rrffm.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, 0, err
+			}
+			rrffm.pacer.increase()
+			continue
+		}
+
+		if resp.StatusCode >= http.StatusInternalServerError {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("transient server error: %s", resp.Status)
+			rrffm.pacer.increase()
+			continue
+		}
+
+		rrffm.pacer.decrease()
+		return resp.Body, resp.ContentLength, nil
+	}
+	return nil, 0, lastErr
+}
+
+func (rrffm *rrffm) doRequest(req *http.Request) ([]byte, *time.Duration, error) {
 	start := time.Now()
-	resp, err := rrffm.httpClient.Post(url, "text/plain", bytes.NewReader(content))
+	resp, err := rrffm.httpClient.Do(req)
 	if err != nil {
 		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, nil, fmt.Errorf("transient server error: %s", resp.Status)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	duration := time.Since(start)
 	if err != nil {
@@ -161,60 +296,232 @@ func (rrffm *rrffm) doPostRequest(url string, content []byte) ([]byte, *time.Dur
 	return body, &duration, nil
 }
 
+// withRetry calls do, retrying on transient failures (network errors and
+// HTTP 5xx, both surfaced as an error by do) with a backoff from rrffm.pacer,
+// up to rrffm.retries times. It gives up immediately if ctx is cancelled.
+func (rrffm *rrffm) withRetry(ctx context.Context, do func() ([]byte, *time.Duration, error)) ([]byte, *time.Duration, error) {
+	var body []byte
+	var duration *time.Duration
+	var err error
+
+	for attempt := 0; attempt <= rrffm.retries; attempt++ {
+		if attempt > 0 {
+			if perr := rrffm.pacer.wait(ctx); perr != nil {
+				return nil, nil, perr
+			}
+		}
+
+		body, duration, err = do()
+		if err == nil {
+			rrffm.pacer.decrease()
+			return body, duration, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+		rrffm.pacer.increase()
+	}
+	return nil, nil, err
+}
+
+// RRFError represents a failure reported by a well-formed or garbled RRF
+// JSON response. Transient is true when the response could not be parsed at
+// all (RRF is known to return truncated JSON under load), signalling to
+// callers that retrying the action may well succeed.
+type RRFError struct {
+	Action    string
+	Transient bool
+}
+
+func (e *RRFError) Error() string {
+	return "Failed to perform: " + e.Action
+}
+
 func (rrffm *rrffm) checkError(action string, resp []byte, err error) error {
 	if err != nil {
 		return err
 	}
-	if string(resp) != noErrorResponse {
-		return errors.New("Failed to perform: " + action)
+	if string(resp) == noErrorResponse {
+		return nil
+	}
+
+	var parsed struct {
+		Err int `json:"err"`
+	}
+	if jsonErr := json.Unmarshal(resp, &parsed); jsonErr != nil {
+		return &RRFError{Action: action, Transient: true}
+	}
+	if parsed.Err != 0 {
+		return &RRFError{Action: action}
 	}
 	return nil
 }
 
-func (rrffm *rrffm) Mkdir(path string) error {
-	resp, _, err := rrffm.doGetRequest(fmt.Sprintf(mkdirURL, rrffm.baseURL, url.QueryEscape(path)))
-	return rrffm.checkError(fmt.Sprintf("Mkdir %s", path), resp, err)
+// retryAction retries action as long as it fails with a transient *RRFError,
+// using the same pacer as the transport-level retries.
+func (rrffm *rrffm) retryAction(ctx context.Context, action func() error) error {
+	var err error
+	for attempt := 0; attempt <= rrffm.retries; attempt++ {
+		if attempt > 0 {
+			if perr := rrffm.pacer.wait(ctx); perr != nil {
+				return perr
+			}
+		}
+
+		err = action()
+		if err == nil {
+			rrffm.pacer.decrease()
+			return nil
+		}
+
+		var rrfErr *RRFError
+		if !errors.As(err, &rrfErr) || !rrfErr.Transient {
+			return err
+		}
+		rrffm.pacer.increase()
+	}
+	return err
+}
+
+func (rrffm *rrffm) Mkdir(ctx context.Context, path string) error {
+	return rrffm.retryAction(ctx, func() error {
+		resp, _, err := rrffm.doGetRequest(ctx, fmt.Sprintf(mkdirURL, rrffm.baseURL, url.QueryEscape(path)))
+		return rrffm.checkError(fmt.Sprintf("Mkdir %s", path), resp, err)
+	})
 }
 
-func (rrffm *rrffm) Move(oldpath, newpath string) error {
-	resp, _, err := rrffm.doGetRequest(fmt.Sprintf(moveURL, rrffm.baseURL, url.QueryEscape(oldpath), url.QueryEscape(newpath)))
-	return rrffm.checkError(fmt.Sprintf("Rename %s to %s", oldpath, newpath), resp, err)
+func (rrffm *rrffm) Move(ctx context.Context, oldpath, newpath string) error {
+	return rrffm.retryAction(ctx, func() error {
+		resp, _, err := rrffm.doGetRequest(ctx, fmt.Sprintf(moveURL, rrffm.baseURL, url.QueryEscape(oldpath), url.QueryEscape(newpath)))
+		return rrffm.checkError(fmt.Sprintf("Rename %s to %s", oldpath, newpath), resp, err)
+	})
 }
 
-func (rrffm *rrffm) MoveOverwrite(oldpath, newpath string) error {
-	if err := rrffm.Delete(newpath); err != nil {
+func (rrffm *rrffm) MoveOverwrite(ctx context.Context, oldpath, newpath string) error {
+	if err := rrffm.Delete(ctx, newpath); err != nil {
 		return err
 	}
-	return rrffm.Move(oldpath, newpath)
+	return rrffm.Move(ctx, oldpath, newpath)
+}
+
+func (rrffm *rrffm) Delete(ctx context.Context, path string) error {
+	return rrffm.retryAction(ctx, func() error {
+		resp, _, err := rrffm.doGetRequest(ctx, fmt.Sprintf(deleteURL, rrffm.baseURL, url.QueryEscape(path)))
+		return rrffm.checkError(fmt.Sprintf("Delete %s", path), resp, err)
+	})
+}
+
+// protectedPaths can only be removed by DeleteRecursive if the
+// AllowDangerous option is set, since removing either of them amounts to
+// wiping the whole SD card or the firmware's own configuration and is far
+// more likely to be a typo'd path than an intentional request.
+var protectedPaths = map[string]bool{
+	"0:":     true,
+	"0:/sys": true,
 }
 
-func (rrffm *rrffm) Delete(path string) error {
-	resp, _, err := rrffm.doGetRequest(fmt.Sprintf(deleteURL, rrffm.baseURL, url.QueryEscape(path)))
-	return rrffm.checkError(fmt.Sprintf("Delete %s", path), resp, err)
+// normalizeRRFPath strips trailing slashes so that e.g. "0:/sys/" and "0:/"
+// are recognized as the same path as "0:/sys" and "0:" when checking
+// protectedPaths.
+func normalizeRRFPath(path string) string {
+	trimmed := strings.TrimRight(path, "/")
+	if trimmed == "" {
+		return "0:"
+	}
+	return trimmed
 }
 
-func (rrffm *rrffm) DeleteRecursive(path string) error {
-	fl, err := rrffm.GetFilelist(path)
+// DeleteRecursive removes path and, if it is a directory, everything
+// beneath it. Refuses to touch a path in protectedPaths unless the
+// AllowDangerous option was passed to New.
+func (rrffm *rrffm) DeleteRecursive(ctx context.Context, path string) error {
+	if !rrffm.allowDangerous && protectedPaths[normalizeRRFPath(path)] {
+		return fmt.Errorf("refusing to recursively delete protected path %q (see WithAllowDangerous)", path)
+	}
+
+	paths, err := rrffm.collectRecursive(ctx, path)
 	if err != nil {
 		return err
 	}
-	for _, f := range fl.Files {
-		if !f.IsDir() {
-
-			// Directories come first so once we get here we can skip the remaining
-			break
-		}
-		if err = rrffm.DeleteRecursive(fmt.Sprint("%s/%s", fl.Dir, f.Name)); err != nil {
+	for _, p := range paths {
+		if err := rrffm.Delete(ctx, p); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// DeleteRecursiveDryRun returns the full list of paths DeleteRecursive would
+// remove for path, in the order it would remove them, without deleting
+// anything. It does not apply the protectedPaths guard since it makes no
+// changes.
+func (rrffm *rrffm) DeleteRecursiveDryRun(ctx context.Context, path string) ([]string, error) {
+	return rrffm.collectRecursive(ctx, path)
+}
+
+// collectRecursive walks path depth-first and returns every path beneath it
+// (files and directories alike) followed by path itself, so that deleting
+// them in order always removes a directory's contents before the directory.
+func (rrffm *rrffm) collectRecursive(ctx context.Context, path string) ([]string, error) {
+	fl, err := rrffm.GetFilelist(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
 	for _, f := range fl.Files {
-		rrffm.Delete(f.Name)
+		childPath := fmt.Sprintf("%s/%s", fl.Dir, f.Name)
+		if f.IsDir() {
+			children, err := rrffm.collectRecursive(ctx, childPath)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, children...)
+			continue
+		}
+		paths = append(paths, childPath)
 	}
-	return nil
+	return append(paths, path), nil
 }
 
-func (rrffm *rrffm) Upload(path string, content []byte) (*time.Duration, error) {
-	resp, duration, err := rrffm.doPostRequest(fmt.Sprintf(uploadURL, rrffm.baseURL, url.QueryEscape(path), url.QueryEscape(rrffm.getTimestamp(time.Now()))), content)
-	return duration, rrffm.checkError(fmt.Sprintf("Uploading file to %s", path), resp, err)
+// Upload streams r directly into the request body instead of buffering it.
+// A garbled ("transient") response from RRF is common under load and would
+// normally be retried, but doing so means re-sending r - if r only supports
+// being read once, a retry would silently POST an empty body instead. So a
+// retry only happens when r is also an io.Seeker, rewinding it to the start
+// before every attempt; otherwise Upload is attempted exactly once and any
+// failure, including a garbled response, is returned directly.
+func (rrffm *rrffm) Upload(ctx context.Context, path string, r io.Reader, size int64, mtime time.Time) error {
+	seeker, seekable := r.(io.Seeker)
+
+	do := func() error {
+		if seekable {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(uploadURL, rrffm.baseURL, url.QueryEscape(path), url.QueryEscape(rrffm.getTimestamp(mtime))), r)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		if size >= 0 {
+			req.ContentLength = size
+		}
+
+		resp, err := rrffm.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		return rrffm.checkError(fmt.Sprintf("Uploading file to %s", path), body, err)
+	}
+
+	if !seekable {
+		return do()
+	}
+	return rrffm.retryAction(ctx, do)
 }
@@ -0,0 +1,184 @@
+package rrffm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeFile mirrors the JSON shape of a single entry in RRF's rr_filelist response.
+type fakeFile struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+	Date string `json:"date"`
+}
+
+// newTestManager spins up a mocked RRF HTTP server serving rr_filelist
+// responses from tree (keyed by the "dir" query parameter) and recording
+// every rr_delete call into deleted, then returns an RRFFileManager pointed
+// at it along with a cleanup func.
+func newTestManager(t *testing.T, tree map[string][]fakeFile, deleted *[]string, opts ...Option) (RRFFileManager, func()) {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/rr_filelist"):
+			dir := r.URL.Query().Get("dir")
+			files, ok := tree[dir]
+			if !ok {
+				t.Fatalf("unexpected rr_filelist request for dir %q", dir)
+			}
+			if err := json.NewEncoder(w).Encode(struct {
+				Dir   string     `json:"dir"`
+				Files []fakeFile `json:"files"`
+				Next  uint64     `json:"next"`
+			}{Dir: dir, Files: files}); err != nil {
+				t.Fatal(err)
+			}
+		case strings.HasPrefix(r.URL.Path, "/rr_delete"):
+			*deleted = append(*deleted, r.URL.Query().Get("name"))
+			w.Write([]byte(noErrorResponse))
+		default:
+			t.Fatalf("unexpected request %s", r.URL.String())
+		}
+	}))
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(u.Hostname(), port, append([]Option{WithRetries(0)}, opts...)...), srv.Close
+}
+
+const testDate = `2021-06-01T12:00:00`
+
+func TestDeleteRecursiveDryRun(t *testing.T) {
+	tests := []struct {
+		name string
+		root string
+		tree map[string][]fakeFile
+		want []string
+	}{
+		{
+			name: "single file",
+			root: "0:/sys/test",
+			tree: map[string][]fakeFile{
+				"0:/sys/test": {{Type: typeFile, Name: "a.g", Size: 1, Date: testDate}},
+			},
+			want: []string{"0:/sys/test/a.g", "0:/sys/test"},
+		},
+		{
+			name: "nested directory",
+			root: "0:/sys/test",
+			tree: map[string][]fakeFile{
+				"0:/sys/test": {
+					{Type: typeDirectory, Name: "sub", Size: 0, Date: testDate},
+					{Type: typeFile, Name: "a.g", Size: 1, Date: testDate},
+				},
+				"0:/sys/test/sub": {{Type: typeFile, Name: "b.g", Size: 2, Date: testDate}},
+			},
+			want: []string{
+				"0:/sys/test/sub/b.g",
+				"0:/sys/test/sub",
+				"0:/sys/test/a.g",
+				"0:/sys/test",
+			},
+		},
+		{
+			name: "empty directory",
+			root: "0:/sys/empty",
+			tree: map[string][]fakeFile{
+				"0:/sys/empty": {},
+			},
+			want: []string{"0:/sys/empty"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deleted []string
+			rfm, closeSrv := newTestManager(t, tt.tree, &deleted)
+			defer closeSrv()
+
+			got, err := rfm.DeleteRecursiveDryRun(context.Background(), tt.root)
+			if err != nil {
+				t.Fatalf("DeleteRecursiveDryRun: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DeleteRecursiveDryRun(%q) = %v, want %v", tt.root, got, tt.want)
+			}
+			if len(deleted) != 0 {
+				t.Errorf("dry run issued rr_delete requests: %v", deleted)
+			}
+		})
+	}
+}
+
+func TestDeleteRecursive(t *testing.T) {
+	tree := map[string][]fakeFile{
+		"0:/sys/test": {
+			{Type: typeDirectory, Name: "sub", Size: 0, Date: testDate},
+			{Type: typeFile, Name: "a.g", Size: 1, Date: testDate},
+		},
+		"0:/sys/test/sub": {{Type: typeFile, Name: "b.g", Size: 2, Date: testDate}},
+	}
+	want := []string{"0:/sys/test/sub/b.g", "0:/sys/test/sub", "0:/sys/test/a.g", "0:/sys/test"}
+
+	var deleted []string
+	rfm, closeSrv := newTestManager(t, tree, &deleted)
+	defer closeSrv()
+
+	if err := rfm.DeleteRecursive(context.Background(), "0:/sys/test"); err != nil {
+		t.Fatalf("DeleteRecursive: %v", err)
+	}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+}
+
+func TestDeleteRecursiveRefusesProtectedPaths(t *testing.T) {
+	for _, path := range []string{"0:/", "0:/sys", "0:/sys/", "0:"} {
+		t.Run(path, func(t *testing.T) {
+			var deleted []string
+			rfm, closeSrv := newTestManager(t, nil, &deleted)
+			defer closeSrv()
+
+			if err := rfm.DeleteRecursive(context.Background(), path); err == nil {
+				t.Fatalf("DeleteRecursive(%q) succeeded, want it to refuse without WithAllowDangerous", path)
+			}
+			if len(deleted) != 0 {
+				t.Errorf("protected path triggered rr_delete requests: %v", deleted)
+			}
+		})
+	}
+}
+
+func TestDeleteRecursiveAllowDangerous(t *testing.T) {
+	tree := map[string][]fakeFile{
+		"0:/sys": {{Type: typeFile, Name: "config.g", Size: 1, Date: testDate}},
+	}
+	want := []string{"0:/sys/config.g", "0:/sys"}
+
+	var deleted []string
+	rfm, closeSrv := newTestManager(t, tree, &deleted, WithAllowDangerous())
+	defer closeSrv()
+
+	if err := rfm.DeleteRecursive(context.Background(), "0:/sys"); err != nil {
+		t.Fatalf("DeleteRecursive with WithAllowDangerous: %v", err)
+	}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+}